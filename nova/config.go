@@ -0,0 +1,169 @@
+package nova
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/metrics"
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/retry"
+)
+
+// Config holds the OpenStack credentials and endpoint information read from
+// the operator-supplied config file. It supports both classic
+// username/password Keystone v3 auth (with domain scoping) and application
+// credential auth, which is the preferred mechanism on modern clouds.
+//
+// gophercloud.AuthOptions only carries two domain concepts: the user's
+// domain (DomainName/DomainID) and, when scoping to a project, the
+// project's domain (Scope.DomainName/DomainID). DomainName/DomainID below
+// is the user's domain for both auth modes; ProjectDomainName/ProjectDomainID
+// scopes the project.
+type Config struct {
+	IdentityEndpoint string
+	Username         string
+	Password         string
+	ProjectName      string
+	ProjectID        string
+	DomainName       string
+	DomainID         string
+
+	ProjectDomainName string
+	ProjectDomainID   string
+
+	ApplicationCredentialID     string
+	ApplicationCredentialName   string
+	ApplicationCredentialSecret string
+
+	Region       string
+	Availability string
+}
+
+// loadConfig reads a simple "key = value" config file. Blank lines and lines
+// starting with '#' are ignored.
+func loadConfig(confPath string) (*Config, error) {
+	f, err := os.Open(confPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open config file: %v", err)
+	}
+	defer f.Close()
+
+	c := &Config{}
+	values := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Cannot parse config line: %q", line)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read config file: %v", err)
+	}
+
+	c.IdentityEndpoint = values["identity_endpoint"]
+	c.Username = values["username"]
+	c.Password = values["password"]
+	c.ProjectName = values["project_name"]
+	c.ProjectID = values["project_id"]
+	c.DomainName = values["domain_name"]
+	c.DomainID = values["domain_id"]
+	c.ProjectDomainName = values["project_domain_name"]
+	c.ProjectDomainID = values["project_domain_id"]
+	c.ApplicationCredentialID = values["application_credential_id"]
+	c.ApplicationCredentialName = values["application_credential_name"]
+	c.ApplicationCredentialSecret = values["application_credential_secret"]
+	c.Region = values["region"]
+	c.Availability = values["availability"]
+
+	if c.IdentityEndpoint == "" {
+		return nil, fmt.Errorf("Config is missing required field: identity_endpoint")
+	}
+	if c.ApplicationCredentialID == "" && c.ApplicationCredentialName == "" && c.Username == "" {
+		return nil, fmt.Errorf("Config must set either username/password or an application credential")
+	}
+
+	return c, nil
+}
+
+// authOptions builds gophercloud.AuthOptions from the config, preferring
+// application credential auth when one is configured since it doesn't
+// require carrying a user password around.
+func (c *Config) authOptions() gophercloud.AuthOptions {
+	ao := gophercloud.AuthOptions{
+		IdentityEndpoint: c.IdentityEndpoint,
+		AllowReauth:      true,
+	}
+
+	if c.ApplicationCredentialID != "" || c.ApplicationCredentialName != "" {
+		ao.ApplicationCredentialID = c.ApplicationCredentialID
+		ao.ApplicationCredentialName = c.ApplicationCredentialName
+		ao.ApplicationCredentialSecret = c.ApplicationCredentialSecret
+		ao.DomainName = c.DomainName
+		ao.DomainID = c.DomainID
+		return ao
+	}
+
+	ao.Username = c.Username
+	ao.Password = c.Password
+	ao.DomainName = c.DomainName
+	ao.DomainID = c.DomainID
+	ao.TenantName = c.ProjectName
+	ao.TenantID = c.ProjectID
+
+	if c.ProjectDomainName != "" || c.ProjectDomainID != "" {
+		ao.Scope = &gophercloud.AuthScope{
+			ProjectName: c.ProjectName,
+			ProjectID:   c.ProjectID,
+			DomainName:  c.ProjectDomainName,
+			DomainID:    c.ProjectDomainID,
+		}
+	}
+
+	return ao
+}
+
+// createOpenstackClient authenticates against Keystone using the credentials
+// found at confPath and returns a Nova (compute) v2 service client. Both
+// Keystone v3 domain-scoped auth and application credential auth are
+// supported; see Config for the accepted fields. ctx bounds the auth call.
+func createOpenstackClient(ctx context.Context, confPath string) (*gophercloud.ServiceClient, error) {
+	conf, err := loadConfig(confPath)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := openstack.NewClient(conf.IdentityEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create openstack provider client: %v", err)
+	}
+	provider.HTTPClient.Transport = metrics.InstrumentTransport(provider.HTTPClient.Transport)
+
+	err = retry.Do(ctx, retry.DefaultPolicy, func() error {
+		return openstack.Authenticate(provider, conf.authOptions())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot authenticate against Keystone: %v", err)
+	}
+
+	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
+		Region:       conf.Region,
+		Availability: gophercloud.Availability(conf.Availability),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create Nova client: %v", err)
+	}
+
+	return client, nil
+}
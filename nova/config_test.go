@@ -0,0 +1,142 @@
+package nova
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nova-drain.conf")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatalf("writing test config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigRequiresIdentityEndpoint(t *testing.T) {
+	path := writeTestConfig(t, "username = alice\npassword = secret\n")
+
+	if _, err := loadConfig(path); err == nil {
+		t.Fatal("expected an error when identity_endpoint is missing")
+	}
+}
+
+func TestLoadConfigRequiresCredentials(t *testing.T) {
+	path := writeTestConfig(t, "identity_endpoint = http://keystone.example:5000/v3\n")
+
+	if _, err := loadConfig(path); err == nil {
+		t.Fatal("expected an error when neither username/password nor an application credential is set")
+	}
+}
+
+func TestLoadConfigAcceptsApplicationCredentialAlone(t *testing.T) {
+	path := writeTestConfig(t, `
+identity_endpoint = http://keystone.example:5000/v3
+application_credential_id = abc123
+application_credential_secret = shh
+`)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.ApplicationCredentialID != "abc123" || c.ApplicationCredentialSecret != "shh" {
+		t.Fatalf("application credential fields not populated: %+v", c)
+	}
+}
+
+func TestLoadConfigPopulatesDomainAndProjectFields(t *testing.T) {
+	path := writeTestConfig(t, `
+identity_endpoint = http://keystone.example:5000/v3
+username = alice
+password = secret
+project_name = demo
+domain_name = default
+project_domain_name = demo-domain
+region = RegionOne
+availability = public
+`)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.DomainName != "default" || c.ProjectDomainName != "demo-domain" || c.ProjectName != "demo" {
+		t.Fatalf("domain/project fields not populated correctly: %+v", c)
+	}
+	if c.Region != "RegionOne" || c.Availability != "public" {
+		t.Fatalf("region/availability fields not populated correctly: %+v", c)
+	}
+}
+
+func TestAuthOptionsPrefersApplicationCredentialOverPassword(t *testing.T) {
+	c := &Config{
+		IdentityEndpoint:            "http://keystone.example:5000/v3",
+		Username:                    "alice",
+		Password:                    "secret",
+		ApplicationCredentialID:     "abc123",
+		ApplicationCredentialSecret: "shh",
+		DomainName:                  "default",
+	}
+
+	ao := c.authOptions()
+
+	if ao.ApplicationCredentialID != "abc123" || ao.ApplicationCredentialSecret != "shh" {
+		t.Fatalf("expected application credential fields to be set: %+v", ao)
+	}
+	if ao.Username != "" || ao.Password != "" {
+		t.Fatalf("expected username/password to be left unset when an application credential is configured: %+v", ao)
+	}
+	if ao.DomainName != "default" {
+		t.Fatalf("expected the user's domain to still be set: %+v", ao)
+	}
+}
+
+func TestAuthOptionsScopesProjectDomain(t *testing.T) {
+	c := &Config{
+		IdentityEndpoint:  "http://keystone.example:5000/v3",
+		Username:          "alice",
+		Password:          "secret",
+		ProjectName:       "demo",
+		ProjectID:         "proj-1",
+		DomainName:        "default",
+		ProjectDomainName: "demo-domain",
+		ProjectDomainID:   "demo-domain-id",
+	}
+
+	ao := c.authOptions()
+
+	if ao.Scope == nil {
+		t.Fatal("expected Scope to be set when a project domain is configured")
+	}
+	if ao.Scope.ProjectName != "demo" || ao.Scope.ProjectID != "proj-1" {
+		t.Fatalf("expected Scope to carry the project name/id: %+v", ao.Scope)
+	}
+	if ao.Scope.DomainName != "demo-domain" || ao.Scope.DomainID != "demo-domain-id" {
+		t.Fatalf("expected Scope to carry the project's domain, not the user's: %+v", ao.Scope)
+	}
+	if ao.DomainName != "default" {
+		t.Fatalf("expected the user's domain to remain on AuthOptions.DomainName: %+v", ao)
+	}
+}
+
+func TestAuthOptionsNoScopeWithoutProjectDomain(t *testing.T) {
+	c := &Config{
+		IdentityEndpoint: "http://keystone.example:5000/v3",
+		Username:         "alice",
+		Password:         "secret",
+		ProjectName:      "demo",
+		DomainName:       "default",
+	}
+
+	ao := c.authOptions()
+
+	if ao.Scope != nil {
+		t.Fatalf("expected no Scope when no project domain is configured, got %+v", ao.Scope)
+	}
+	if ao.TenantName != "demo" {
+		t.Fatalf("expected unscoped auth to still carry the project via TenantName: %+v", ao)
+	}
+}
@@ -0,0 +1,36 @@
+package nova
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/stackanetes/kubernetes-entrypoint/logger"
+)
+
+// migrationEvent is a structured record of a single eviction attempt. It's
+// logged as JSON alongside the existing free-form logger calls so operators
+// can correlate drains with Kubernetes node cordons.
+type migrationEvent struct {
+	VMID       string  `json:"vm_id"`
+	SourceHost string  `json:"source_host"`
+	TargetHost string  `json:"target_host,omitempty"`
+	Step       string  `json:"step"`
+	Attempt    int     `json:"attempt"`
+	Result     string  `json:"result"`
+	DurationS  float64 `json:"duration_seconds"`
+}
+
+// logMigrationEvent emits e as a single line of JSON via the existing info
+// logger.
+func logMigrationEvent(e migrationEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		logger.Warning.Printf("Cannot encode migration event: %v", err)
+		return
+	}
+	logger.Info.Println(string(body))
+}
+
+func seconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
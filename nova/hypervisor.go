@@ -1,25 +1,37 @@
 package nova
 
 import (
+	"context"
 	"fmt"
-	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/rackspace/gophercloud"
-	"github.com/rackspace/gophercloud/openstack/compute/v2/extensions/adminactions"
-	"github.com/rackspace/gophercloud/openstack/compute/v2/servers"
-	"github.com/rackspace/gophercloud/pagination"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/migrate"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/pagination"
 	"github.com/stackanetes/kubernetes-entrypoint/logger"
+
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/metrics"
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/ratelimit"
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/retry"
 )
 
 const (
-	retryInterval         = 2
 	novaComputeBinaryName = "nova-compute"
 	enabledString         = "enabled"
-	retryNum              = 3
+
+	// DefaultMaxConcurrentMigrations bounds how many VMs MigrateVMs evicts
+	// at once when Hypervisor.MaxConcurrentMigrations is unset.
+	DefaultMaxConcurrentMigrations = 4
+
+	// pollRatePerSecond and pollBurst throttle GET /servers polling done
+	// while waiting for a VM to change state, independent of the backoff
+	// already applied between retries of a single request.
+	pollRatePerSecond = 5
+	pollBurst         = 5
 )
 
 // Service is a struct which represents single Openstack service
@@ -47,6 +59,23 @@ type Hypervisor struct {
 	timeOut  time.Duration
 	vms      *[]servers.Server
 	Enabled  bool
+
+	// PolicySteps is the ordered pipeline of eviction techniques MigrateVMs
+	// tries against each VM until it leaves this host or a terminal failure
+	// is hit. Defaults to DefaultPolicySteps.
+	PolicySteps []Step
+
+	// Plan, when set from a prior call to PlanDrain, pins each VM's
+	// live-migrate and evacuate steps to the target host PlanDrain scheduled
+	// it on instead of leaving placement to Nova's default scheduler. The
+	// cold-migrate step is still placed by the scheduler.
+	Plan *DrainPlan
+
+	// MaxConcurrentMigrations caps how many VMs MigrateVMs evicts at once.
+	// Defaults to DefaultMaxConcurrentMigrations.
+	MaxConcurrentMigrations int
+
+	pollLimiter *ratelimit.Limiter
 }
 
 // NovaServer is struct which represents Nova server returned by OpenStack API
@@ -70,16 +99,22 @@ type Server struct {
 	// KeyName indicates which public key was injected into the server on launch.
 	KeyName string `json:"key_name" mapstructure:"key_name"`
 
+	// TaskState and VMState come from the OS-EXT-STS extension and expose
+	// Nova's internal state machine (e.g. "migrating", "shelved",
+	// "error") which Status alone doesn't distinguish.
+	TaskState string `json:"OS-EXT-STS:task_state" mapstructure:"OS-EXT-STS:task_state"`
+	VMState   string `json:"OS-EXT-STS:vm_state" mapstructure:"OS-EXT-STS:vm_state"`
 }
 
-// New is a constructor for Hypervisor.
-func New(confPath string, timeOut int) (*Hypervisor, error) {
+// New is a constructor for Hypervisor. ctx bounds the initial Keystone
+// authentication call; it is not retained on the returned Hypervisor.
+func New(ctx context.Context, confPath string, timeOut int) (*Hypervisor, error) {
 	to := time.Duration(timeOut) * time.Minute
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, fmt.Errorf("Cannot retrieve hostname: %v", err)
 	}
-	client, err := createOpenstackClient(confPath)
+	client, err := createOpenstackClient(ctx, confPath)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot create openstack client: %v", err)
 	}
@@ -88,40 +123,36 @@ func New(confPath string, timeOut int) (*Hypervisor, error) {
 			"binary": "nova-compute",
 			"host":   hostname,
 		},
-		client:   client,
-		confPath: confPath,
-		hostname: hostname,
-		timeOut:  to,
-		Enabled:  true,
+		client:                  client,
+		confPath:                confPath,
+		hostname:                hostname,
+		timeOut:                 to,
+		Enabled:                 true,
+		PolicySteps:             DefaultPolicySteps,
+		MaxConcurrentMigrations: DefaultMaxConcurrentMigrations,
+		pollLimiter:             ratelimit.New(pollRatePerSecond, pollBurst),
 	}, nil
 }
 
-func (n *Hypervisor) novaServices() ([]Service, error) {
+func (n *Hypervisor) novaServices(ctx context.Context) ([]Service, error) {
 	nova := new(NovaService)
 	url := n.client.ServiceURL("os-services")
-	resp, err := n.client.Request("GET", url, gophercloud.RequestOpts{
-		OkCodes: []int{200, 204},
+
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		_, err := n.client.Get(url, nova, &gophercloud.RequestOpts{
+			OkCodes: []int{200, 204},
+		})
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Cannot gather openstack-service list: %v", err)
 	}
 
-	if err = getJson(resp.Body, &nova); err != nil {
-		err = fmt.Errorf("Cannot decode JSON: %v", err)
-	}
-
-	return nova.Services, err
+	return nova.Services, nil
 }
-func (n *Hypervisor) hypervisorStatus() (bool, error) {
-	var err error
-	var services []Service
-
-	for a := 0; a < retryNum; a++ {
-		services, err = n.novaServices()
-		if err == nil {
-			break
-		}
-	}
+
+func (n *Hypervisor) hypervisorStatus(ctx context.Context) (bool, error) {
+	services, err := n.novaServices(ctx)
 	if err != nil {
 		return false, fmt.Errorf("Cannot obtain nova-compute services: %v", err)
 	}
@@ -137,15 +168,9 @@ func (n *Hypervisor) hypervisorStatus() (bool, error) {
 	return false, fmt.Errorf("Cannot find nova-service with hostname: %s", n.hostname)
 }
 
-func (n *Hypervisor) RefreshState() (err error) {
-	var status bool
-
-	for a := 0; a < retryNum; a++ {
-		status, err = n.hypervisorStatus()
-		if err == nil {
-			break
-		}
-	}
+// RefreshState re-reads this hypervisor's nova-compute service status.
+func (n *Hypervisor) RefreshState(ctx context.Context) error {
+	status, err := n.hypervisorStatus(ctx)
 	if err != nil {
 		return fmt.Errorf("Cannot update hypervisor state: %v", err)
 	}
@@ -153,52 +178,43 @@ func (n *Hypervisor) RefreshState() (err error) {
 		logger.Info.Printf("Hypervisior status updated. New status = %v", status)
 		n.Enabled = status
 	}
-	return
+	return nil
 }
 
 // Disable disable node and scheduling on it.
-func (n *Hypervisor) Disable() error {
-	var resp *http.Response
-	var err error
-
+func (n *Hypervisor) Disable(ctx context.Context) error {
 	url := n.client.ServiceURL("os-services", "disable")
-	for a := 0; a < retryNum; a++ {
-		resp, err = n.client.Request("PUT", url, gophercloud.RequestOpts{
-			JSONBody: n.body,
-			OkCodes:  []int{200, 204},
+
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		_, err := n.client.Put(url, n.body, nil, &gophercloud.RequestOpts{
+			OkCodes: []int{200, 204},
 		})
-		if err == nil {
-			break
-		}
-	}
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Cannot change node state. Recieved code: %s.\nError: %v", resp.StatusCode, err)
+		return fmt.Errorf("Cannot change node state: %v", err)
 	}
 
+	metrics.HypervisorDisableTotal.Inc()
 	logger.Info.Println("Node disabled.")
 	n.Enabled = false
 
-	return err
+	return nil
 }
 
 // Enable change node state to enable
-func (n *Hypervisor) Enable() error {
-	var err error
-	var resp *http.Response
-
+func (n *Hypervisor) Enable(ctx context.Context) error {
 	url := n.client.ServiceURL("os-services", "enable")
-	for a := 0; a < retryNum; a++ {
-		resp, err = n.client.Request("PUT", url, gophercloud.RequestOpts{
-			JSONBody: n.body,
-			OkCodes:  []int{200, 204},
+
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		_, err := n.client.Put(url, n.body, nil, &gophercloud.RequestOpts{
+			OkCodes: []int{200, 204},
 		})
-		if err == nil {
-			break
-		}
-	}
+		return err
+	})
 	if err != nil {
 		logger.Error.Println("Cannot change node state.")
-		return fmt.Errorf("Recieved code: %s.\nError: %v", resp.StatusCode, err)
+		return fmt.Errorf("Cannot change node state: %v", err)
 	}
 	logger.Info.Println("Node enabled.")
 	n.Enabled = true
@@ -206,128 +222,154 @@ func (n *Hypervisor) Enable() error {
 	return nil
 }
 
-func (n *Hypervisor) isMigrated(vmID string, hostID string) (bool, error) {
-	var err error
-	var resp *http.Response
+// serverDetail fetches the current server representation, including its
+// OS-EXT-STS task/VM state, for a single VM.
+func (n *Hypervisor) serverDetail(ctx context.Context, vmID string) (*Server, error) {
+	if err := n.pollLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
 
 	vm := new(NovaServer)
 	url := n.client.ServiceURL("servers", vmID)
-	for a := 0; a < retryNum; a++ {
-		resp, err = n.client.Request("GET", url, gophercloud.RequestOpts{
+
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		_, err := n.client.Get(url, vm, &gophercloud.RequestOpts{
 			OkCodes: []int{200, 204},
 		})
-		if err == nil {
-			break
-		}
-	}
+		return err
+	})
 	if err != nil {
-		return false, fmt.Errorf("Cannot gather server %v information: %v", vmID, err)
-	}
-
-	if err = getJson(resp.Body, &vm); err != nil {
-		return false, fmt.Errorf("Cannot decode JSON: %v", err)
-	}
-	if vm.Server.HostID != hostID {
-		return true, nil
+		return nil, fmt.Errorf("Cannot gather server %v information: %v", vmID, err)
 	}
 
-	return false, nil
+	return &vm.Server, nil
 }
 
-// MigrateVMs live migrate all VMs out of node
-func (h *Hypervisor) MigrateVMs() (err error) {
-	var wg sync.WaitGroup
-	if err = h.updateVMList(); err != nil {
-		return fmt.Errorf("Cannot update server list: ", err)
+// MigrateVMs evicts every VM out of this node. It stops waiting when ctx is
+// cancelled (e.g. SIGTERM from Kubernetes) or the drain timeout elapses,
+// whichever comes first.
+func (h *Hypervisor) MigrateVMs(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeOut)
+	defer cancel()
+
+	if err := h.updateVMList(ctx); err != nil {
+		return fmt.Errorf("Cannot update server list: %v", err)
+	}
+
+	maxConcurrent := h.MaxConcurrentMigrations
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrentMigrations
 	}
+	workers := make(chan struct{}, maxConcurrent)
 
+	var wg sync.WaitGroup
 	for _, vm := range *h.vms {
-		wg.Add(1)
+		targetHost := ""
+		if h.Plan != nil {
+			targetHost = h.Plan.Targets[vm.ID]
+		}
 
-		go func(vmID string, hostID string) {
+		wg.Add(1)
+		go func(vmID string, hostID string, targetHost string) {
 			defer wg.Done()
-			migrated := h.migrateVMWithBM(vmID)
-			if !migrated {
-				logger.Info.Printf("Cannot migrate VM: %v.", vmID)
+
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				logger.Warning.Printf("VM: %v. Drain cancelled before an eviction slot freed up.", vmID)
 				return
 			}
+			defer func() { <-workers }()
 
-			migrated = false
-			for counter := 0; !migrated; counter++ {
-				migrated, err = h.isMigrated(vmID, hostID)
-				if err != nil {
-					logger.Warning.Printf("Cannot update VM: %v status: %v", vmID, err)
-				}
-				if migrated {
-					logger.Info.Printf("VM: %v has been migrated.", vmID)
-				} else {
-					logger.Info.Printf("VM: %v has not been migrated.", vmID)
-					time.Sleep(time.Duration(counter*10) * time.Second)
-				}
+			if h.runPolicy(ctx, vmID, hostID, targetHost) {
+				logger.Info.Printf("VM: %v has been evicted from host %v.", vmID, hostID)
+				metrics.VMsRemaining.Dec()
+			} else {
+				logger.Warning.Printf("VM: %v could not be evicted from host %v.", vmID, hostID)
 			}
-		}(vm.ID, vm.HostID)
+		}(vm.ID, vm.HostID, targetHost)
 	}
 
-	if waitTimeout(&wg, h.timeOut) {
-		logger.Warning.Println("Time out waiting for live-migration.")
-	} else {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
 		logger.Warning.Println("All VMs migrated")
+	case <-ctx.Done():
+		logger.Warning.Println("Time out waiting for live-migration.")
 	}
 
-	return
+	return nil
 }
 
-func (h *Hypervisor) migrateVMWithBM(vmID string) (migrated bool) {
-	migrated = false
-	for a := 1; a < retryNum+1; a++ {
-		er := adminactions.LiveMigrate(h.client, vmID, adminactions.LiveMigrateOpts{
-			BlockMigration: true,
-		})
-		if er.Result.Err == nil {
-			logger.Info.Printf("Attempt: %d. Request to migrate VM with BlockMigration %s accepted\n", a, vmID)
-			migrated = true
-			break
-			// TODO(DTadrzak): compare status code to 400 when new openstack client will be released
-		} else if strings.Contains(er.Result.Err.Error(), "Block migration can not be used with shared storage.") {
-			return h.migrateVMWithoutBM(vmID)
-		}
+// migrateVMWithBM live-migrates vmID with block migration enabled. When
+// targetHost is non-empty (typically supplied by a DrainPlan), it pins the
+// migration to that host instead of leaving placement to the scheduler.
+// The returned mode reflects which migration kind actually ran (it falls
+// back to migrateVMWithoutBM's "shared" on a shared-storage rejection),
+// for callers that label metrics/events with it.
+func (h *Hypervisor) migrateVMWithBM(ctx context.Context, vmID, targetHost string) (mode string, migrated bool) {
+	block := true
+	opts := migrate.LiveMigrateOpts{BlockMigration: &block}
+	if targetHost != "" {
+		opts.Host = &targetHost
+	}
 
-		logger.Warning.Printf("Attempt: %d. Cannot run migratation of VM %s: %v.\n", a, vmID, er.Result.Err)
-		time.Sleep(time.Duration(a*10) * time.Second)
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		er := migrate.LiveMigrate(h.client, vmID, opts)
+		return er.Err
+	})
+	if err == nil {
+		logger.Info.Printf("Request to migrate VM with BlockMigration %s accepted\n", vmID)
+		return metrics.MigrationModeBlock, true
+	}
+	if strings.Contains(err.Error(), retry.BlockMigrationSharedStorageError) {
+		return h.migrateVMWithoutBM(ctx, vmID, targetHost)
 	}
-	return
+
+	logger.Warning.Printf("Cannot run migratation of VM %s: %v.\n", vmID, err)
+	return metrics.MigrationModeBlock, false
 }
 
-func (h *Hypervisor) migrateVMWithoutBM(vmID string) (migrated bool) {
-	migrated = false
-	for a := 1; a < retryNum+1; a++ {
-		er := adminactions.LiveMigrate(h.client, vmID, adminactions.LiveMigrateOpts{
-			BlockMigration: false,
-		})
-		if er.Result.Err == nil {
-			logger.Info.Printf("Attempt: %d. Request to migrate VM without BlockMigration %s accepted\n", a, vmID)
-			migrated = true
-			break
-		}
+func (h *Hypervisor) migrateVMWithoutBM(ctx context.Context, vmID, targetHost string) (mode string, migrated bool) {
+	block := false
+	opts := migrate.LiveMigrateOpts{BlockMigration: &block}
+	if targetHost != "" {
+		opts.Host = &targetHost
+	}
 
-		logger.Warning.Printf("Attempt: %d. Cannot run migratation of VM %s: %v.\n", a, vmID, er.Result.Err)
-		time.Sleep(time.Duration(a*10) * time.Second)
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		er := migrate.LiveMigrate(h.client, vmID, opts)
+		return er.Err
+	})
+	if err != nil {
+		logger.Warning.Printf("Cannot run migratation of VM %s: %v.\n", vmID, err)
+		return metrics.MigrationModeShared, false
 	}
-	return
+
+	logger.Info.Printf("Request to migrate VM without BlockMigration %s accepted\n", vmID)
+	return metrics.MigrationModeShared, true
 }
 
-func (n *Hypervisor) updateVMList() (err error) {
-	pager := servers.List(n.client, servers.ListOpts{
-		Host: n.hostname,
-	})
+func (n *Hypervisor) updateVMList(ctx context.Context) error {
 	vms := []servers.Server{}
 
-	err = pager.EachPage(func(page pagination.Page) (bool, error) {
-		vms, err = servers.ExtractServers(page)
-		if err != nil {
-			return false, err
-		}
-		return true, nil
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		pager := servers.List(n.client, servers.ListOpts{
+			Host: n.hostname,
+		})
+		return pager.EachPage(func(page pagination.Page) (bool, error) {
+			extracted, err := servers.ExtractServers(page)
+			if err != nil {
+				return false, err
+			}
+			vms = extracted
+			return true, nil
+		})
 	})
 	if err != nil {
 		return fmt.Errorf("Cannot retrieve server list from Pager: %v", err)
@@ -335,6 +377,7 @@ func (n *Hypervisor) updateVMList() (err error) {
 
 	logger.Info.Printf("Retrive list of %d VMs for this host.\n", len(vms))
 	n.vms = &vms
+	metrics.VMsRemaining.Set(float64(len(vms)))
 
 	return nil
 }
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRouteTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "vm action endpoint",
+			path: "/servers/b16ba811-199d-4ffd-8839-ba96c1185a67/action",
+			want: "/servers/{id}/action",
+		},
+		{
+			name: "vm detail endpoint",
+			path: "/servers/b16ba811-199d-4ffd-8839-ba96c1185a67",
+			want: "/servers/{id}",
+		},
+		{
+			name: "static endpoint is untouched",
+			path: "/os-services/disable",
+			want: "/os-services/disable",
+		},
+		{
+			name: "non-uuid resource id is untouched",
+			path: "/flavors/m1.small",
+			want: "/flavors/m1.small",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routeTemplate(tt.path); got != tt.want {
+				t.Errorf("routeTemplate(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestInstrumentTransportAggregatesAcrossVMs asserts the fix for the
+// cardinality bug: two different VM UUIDs hitting the same route must
+// land on the same APIRequestDuration series, not mint a new one each.
+func TestInstrumentTransportAggregatesAcrossVMs(t *testing.T) {
+	transport := InstrumentTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 202, Request: req}, nil
+	}))
+
+	before := testutil.CollectAndCount(APIRequestDuration)
+
+	req1, _ := http.NewRequest("POST", "http://nova.example/servers/b16ba811-199d-4ffd-8839-ba96c1185a67/action", nil)
+	if _, err := transport.RoundTrip(req1); err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	afterFirstVM := testutil.CollectAndCount(APIRequestDuration)
+	if afterFirstVM != before+1 {
+		t.Fatalf("expected a new series for a route not seen before, went from %d to %d", before, afterFirstVM)
+	}
+
+	req2, _ := http.NewRequest("POST", "http://nova.example/servers/9a184f74-088c-49f7-9ab8-ed0dd4d7b9c9/action", nil)
+	if _, err := transport.RoundTrip(req2); err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	afterSecondVM := testutil.CollectAndCount(APIRequestDuration)
+	if afterSecondVM != afterFirstVM {
+		t.Fatalf("expected the second VM's request to reuse the same series, series count went from %d to %d", afterFirstVM, afterSecondVM)
+	}
+}
@@ -0,0 +1,198 @@
+package nova
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/hypervisors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/pagination"
+
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/retry"
+)
+
+const (
+	hypervisorStateUp       = "up"
+	hypervisorStatusEnabled = "enabled"
+)
+
+// DrainPlan is the result of PlanDrain: a per-VM placement suggestion plus
+// an overall feasibility verdict for draining a single hypervisor.
+type DrainPlan struct {
+	// Feasible is true when every VM on the host was assigned a target
+	// with enough free capacity.
+	Feasible bool
+
+	// Targets maps a VM ID to the hostname PlanDrain suggests migrating it
+	// to.
+	Targets map[string]string
+
+	// Unplaceable lists the VM IDs PlanDrain could not fit anywhere in the
+	// availability zone.
+	Unplaceable []string
+
+	// Reason explains why Feasible is false. Empty when Feasible is true.
+	Reason string
+}
+
+// hostCapacity tracks a candidate target host's free resources as PlanDrain
+// tentatively assigns VMs to it.
+type hostCapacity struct {
+	hostname   string
+	freeVCPUs  int
+	freeMemMB  int
+	freeDiskGB int
+}
+
+// PlanDrain lists candidate target hosts in this hypervisor's availability
+// zone and the flavors of the VMs it's currently running, then assigns each
+// VM, first-fit, to a single remaining host with enough free vCPU/RAM/disk
+// for its flavor, deducting that flavor from the host's free capacity. The
+// plan is feasible only if every VM was assigned a host. It should be
+// called before Disable so an operator can abort a
+// drain that has nowhere to send its VMs.
+func (h *Hypervisor) PlanDrain(ctx context.Context) (*DrainPlan, error) {
+	if h.vms == nil {
+		if err := h.updateVMList(ctx); err != nil {
+			return nil, fmt.Errorf("Cannot update server list: %v", err)
+		}
+	}
+
+	zone, err := h.zone(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := h.candidateHosts(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &DrainPlan{
+		Feasible: true,
+		Targets:  map[string]string{},
+	}
+
+	for _, vm := range *h.vms {
+		flavor, err := h.flavorOf(ctx, vm)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot determine flavor for VM %s: %v", vm.ID, err)
+		}
+
+		target := pickCandidate(candidates, flavor)
+		if target == nil {
+			plan.Feasible = false
+			plan.Unplaceable = append(plan.Unplaceable, vm.ID)
+			continue
+		}
+
+		target.freeVCPUs -= flavor.VCPUs
+		target.freeMemMB -= flavor.RAM
+		target.freeDiskGB -= flavor.Disk
+		plan.Targets[vm.ID] = target.hostname
+	}
+
+	if !plan.Feasible {
+		plan.Reason = fmt.Sprintf("Not enough capacity in availability zone %s to land %d VM(s)", zone, len(plan.Unplaceable))
+	}
+
+	return plan, nil
+}
+
+// pickCandidate returns the first host with enough free capacity for
+// flavor, or nil if none qualify.
+func pickCandidate(hosts []*hostCapacity, flavor *flavors.Flavor) *hostCapacity {
+	for _, host := range hosts {
+		if host.freeVCPUs >= flavor.VCPUs && host.freeMemMB >= flavor.RAM && host.freeDiskGB >= flavor.Disk {
+			return host
+		}
+	}
+	return nil
+}
+
+// zone returns the availability zone this hypervisor's nova-compute service
+// is registered in.
+func (h *Hypervisor) zone(ctx context.Context) (string, error) {
+	services, err := h.novaServices(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Cannot determine availability zone: %v", err)
+	}
+	for _, service := range services {
+		if service.Host == h.hostname && service.Binary == novaComputeBinaryName {
+			return service.Zone, nil
+		}
+	}
+	return "", fmt.Errorf("Cannot find nova-service with hostname: %s", h.hostname)
+}
+
+// candidateHosts lists the enabled, up hypervisors in zone other than this
+// one, along with their current free capacity.
+func (h *Hypervisor) candidateHosts(ctx context.Context, zone string) ([]*hostCapacity, error) {
+	services, err := h.novaServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list candidate hosts: %v", err)
+	}
+	zoneByHost := map[string]string{}
+	for _, service := range services {
+		if service.Binary == novaComputeBinaryName {
+			zoneByHost[service.Host] = service.Zone
+		}
+	}
+
+	var hvs []hypervisors.Hypervisor
+	err = retry.Do(ctx, retry.DefaultPolicy, func() error {
+		pager := hypervisors.List(h.client, hypervisors.ListOpts{})
+		return pager.EachPage(func(page pagination.Page) (bool, error) {
+			extracted, err := hypervisors.ExtractHypervisors(page)
+			if err != nil {
+				return false, err
+			}
+			hvs = extracted
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list hypervisors: %v", err)
+	}
+
+	var candidates []*hostCapacity
+	for _, hv := range hvs {
+		if hv.Service.Host == h.hostname {
+			continue
+		}
+		if zoneByHost[hv.Service.Host] != zone {
+			continue
+		}
+		if hv.State != hypervisorStateUp || hv.Status != hypervisorStatusEnabled {
+			continue
+		}
+		candidates = append(candidates, &hostCapacity{
+			hostname:   hv.Service.Host,
+			freeVCPUs:  hv.VCPUs - hv.VCPUsUsed,
+			freeMemMB:  hv.MemoryMB - hv.MemoryMBUsed,
+			freeDiskGB: hv.LocalGB - hv.LocalGBUsed,
+		})
+	}
+
+	return candidates, nil
+}
+
+// flavorOf resolves the flavor a running VM was booted with.
+func (h *Hypervisor) flavorOf(ctx context.Context, vm servers.Server) (*flavors.Flavor, error) {
+	id, _ := vm.Flavor["id"].(string)
+	if id == "" {
+		return nil, fmt.Errorf("VM %s has no flavor id", vm.ID)
+	}
+
+	var flavor *flavors.Flavor
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		f, err := flavors.Get(h.client, id).Extract()
+		if err != nil {
+			return err
+		}
+		flavor = f
+		return nil
+	})
+	return flavor, err
+}
@@ -0,0 +1,49 @@
+package nova
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+)
+
+func TestPickCandidateReturnsFirstHostWithCapacity(t *testing.T) {
+	hosts := []*hostCapacity{
+		{hostname: "compute-2", freeVCPUs: 1, freeMemMB: 1024, freeDiskGB: 10},
+		{hostname: "compute-3", freeVCPUs: 8, freeMemMB: 16384, freeDiskGB: 200},
+	}
+	flavor := &flavors.Flavor{VCPUs: 4, RAM: 8192, Disk: 80}
+
+	got := pickCandidate(hosts, flavor)
+	if got == nil || got.hostname != "compute-3" {
+		t.Fatalf("expected compute-3, got %+v", got)
+	}
+}
+
+func TestPickCandidateReturnsNilWhenNothingFits(t *testing.T) {
+	hosts := []*hostCapacity{
+		{hostname: "compute-2", freeVCPUs: 1, freeMemMB: 1024, freeDiskGB: 10},
+	}
+	flavor := &flavors.Flavor{VCPUs: 4, RAM: 8192, Disk: 80}
+
+	if got := pickCandidate(hosts, flavor); got != nil {
+		t.Fatalf("expected no candidate to fit, got %+v", got)
+	}
+}
+
+func TestPickCandidateDecrementsCallerTracksUsage(t *testing.T) {
+	host := &hostCapacity{hostname: "compute-2", freeVCPUs: 4, freeMemMB: 8192, freeDiskGB: 80}
+	flavor := &flavors.Flavor{VCPUs: 4, RAM: 8192, Disk: 80}
+
+	got := pickCandidate([]*hostCapacity{host}, flavor)
+	if got != host {
+		t.Fatalf("expected exact-fit host to be picked, got %+v", got)
+	}
+
+	got.freeVCPUs -= flavor.VCPUs
+	got.freeMemMB -= flavor.RAM
+	got.freeDiskGB -= flavor.Disk
+
+	if pickCandidate([]*hostCapacity{host}, flavor) != nil {
+		t.Fatal("expected host to be exhausted after a second identical placement")
+	}
+}
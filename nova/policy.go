@@ -0,0 +1,204 @@
+package nova
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/evacuate"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/migrate"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/shelveunshelve"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/startstop"
+	"github.com/stackanetes/kubernetes-entrypoint/logger"
+
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/metrics"
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/retry"
+)
+
+// Step identifies a single eviction technique MigrateVMs can attempt against
+// a VM while draining a hypervisor.
+type Step string
+
+const (
+	// LiveMigrateStep asks Nova to live-migrate the VM to another host with
+	// no interruption of service.
+	LiveMigrateStep Step = "live-migrate"
+	// ColdMigrateStep powers the VM off, relocates its disk, and boots it
+	// again on another host. Works for VMs that can't live-migrate, e.g.
+	// ones pinned to local storage.
+	ColdMigrateStep Step = "cold-migrate"
+	// ShelveStep shelves the VM, releasing the compute resources it holds
+	// on this host without deleting the instance.
+	ShelveStep Step = "shelve"
+	// StopStep stops the VM in place. It doesn't leave the host, but it
+	// stops consuming compute resources so the hypervisor can be drained.
+	StopStep Step = "stop"
+	// EvacuateStep rebuilds the VM on another host from its image. Used as
+	// a last resort when the source hypervisor is being decommissioned and
+	// can't be migrated from at all.
+	EvacuateStep Step = "evacuate"
+)
+
+// Nova VM/task states surfaced through the OS-EXT-STS extension that the
+// policy engine checks for step completion or terminal failure.
+const (
+	vmStateError            = "error"
+	vmStateShelved          = "shelved"
+	vmStateShelvedOffloaded = "shelved_offloaded"
+	serverStatusShutoff     = "SHUTOFF"
+)
+
+// DefaultPolicySteps is the eviction pipeline used when a Hypervisor is
+// created without an explicit PolicySteps override.
+var DefaultPolicySteps = []Step{LiveMigrateStep, ColdMigrateStep, ShelveStep, StopStep, EvacuateStep}
+
+// runPolicy tries each configured step against vmID in order, until the VM
+// leaves hostID, reaches its step's goal state in place (stopped/shelved),
+// a step hits a terminal failure (an ERROR VMState), or every step has been
+// exhausted. When targetHost is non-empty, the live-migrate and evacuate
+// steps are pinned to it rather than left to the scheduler.
+func (h *Hypervisor) runPolicy(ctx context.Context, vmID, hostID, targetHost string) bool {
+	steps := h.PolicySteps
+	if len(steps) == 0 {
+		steps = DefaultPolicySteps
+	}
+
+	stepTimeout := h.timeOut / time.Duration(len(steps))
+
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			logger.Warning.Printf("VM: %v. Drain cancelled before step %s.", vmID, step)
+			return false
+		}
+
+		logger.Info.Printf("VM: %v. Attempting eviction step: %s.", vmID, step)
+
+		mode, err := h.executeStep(ctx, step, vmID, targetHost)
+		if err != nil {
+			logger.Warning.Printf("VM: %v. Step %s failed to start: %v.", vmID, step, err)
+			continue
+		}
+
+		succeeded, terminal := h.waitForStep(ctx, step, mode, vmID, hostID, targetHost, stepTimeout)
+		if succeeded {
+			logger.Info.Printf("VM: %v. Step %s succeeded.", vmID, step)
+			return true
+		}
+		if terminal {
+			logger.Warning.Printf("VM: %v. Step %s hit a terminal failure; remaining steps skipped.", vmID, step)
+			return false
+		}
+		logger.Warning.Printf("VM: %v. Step %s did not complete within %s.", vmID, step, stepTimeout)
+	}
+
+	return false
+}
+
+// executeStep issues the API call for a single step. It does not wait for
+// the resulting state transition; use waitForStep for that. The returned
+// mode is only meaningful for LiveMigrateStep (block vs shared-storage
+// live migration); other steps return the step name for metrics/event
+// labeling since block/shared doesn't apply to them.
+func (h *Hypervisor) executeStep(ctx context.Context, step Step, vmID, targetHost string) (mode string, err error) {
+	switch step {
+	case LiveMigrateStep:
+		mode, ok := h.migrateVMWithBM(ctx, vmID, targetHost)
+		if !ok {
+			return mode, fmt.Errorf("live migration request was rejected")
+		}
+		return mode, nil
+	case ColdMigrateStep:
+		// Cold migrate has no host-pinning option upstream; targetHost is
+		// only honored by the live-migrate and evacuate steps.
+		return string(step), retry.Do(ctx, retry.DefaultPolicy, func() error {
+			er := migrate.Migrate(h.client, vmID)
+			return er.Err
+		})
+	case ShelveStep:
+		return string(step), retry.Do(ctx, retry.DefaultPolicy, func() error {
+			er := shelveunshelve.Shelve(h.client, vmID)
+			return er.Err
+		})
+	case StopStep:
+		return string(step), retry.Do(ctx, retry.DefaultPolicy, func() error {
+			er := startstop.Stop(h.client, vmID)
+			return er.Err
+		})
+	case EvacuateStep:
+		return string(step), retry.Do(ctx, retry.DefaultPolicy, func() error {
+			er := evacuate.Evacuate(h.client, vmID, evacuate.EvacuateOpts{Host: targetHost})
+			return er.Err
+		})
+	default:
+		return string(step), fmt.Errorf("unknown eviction step: %s", step)
+	}
+}
+
+// waitForStep polls the VM until it reaches step's goal state, an ERROR
+// VMState is observed, ctx is cancelled, or timeout elapses. mode labels
+// the migration/duration metrics and event record; it's the block/shared
+// outcome executeStep observed for LiveMigrateStep, or the step name
+// otherwise. terminal is true when the step ended on an ERROR VMState.
+func (h *Hypervisor) waitForStep(ctx context.Context, step Step, mode, vmID, hostID, targetHost string, timeout time.Duration) (succeeded, terminal bool) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	attempt := 0
+
+	finish := func(result string) (bool, bool) {
+		metrics.VMMigrationsTotal.WithLabelValues(result, mode).Inc()
+		metrics.VMMigrationDuration.WithLabelValues(mode).Observe(seconds(time.Since(start)))
+		logMigrationEvent(migrationEvent{
+			VMID:       vmID,
+			SourceHost: hostID,
+			TargetHost: targetHost,
+			Step:       string(step),
+			Attempt:    attempt + 1,
+			Result:     result,
+			DurationS:  seconds(time.Since(start)),
+		})
+		return result == "success", result == "failed"
+	}
+
+	for ; ctx.Err() == nil; attempt++ {
+		vm, err := h.serverDetail(ctx, vmID)
+		if err != nil {
+			logger.Warning.Printf("Cannot update VM: %v status: %v", vmID, err)
+			sleep(ctx, time.Duration(attempt*10)*time.Second)
+			continue
+		}
+
+		if vm.VMState == vmStateError {
+			logger.Warning.Printf("VM: %v entered ERROR state during step %s.", vmID, step)
+			return finish("failed")
+		}
+
+		switch step {
+		case StopStep:
+			if vm.Status == serverStatusShutoff {
+				return finish("success")
+			}
+		case ShelveStep:
+			if vm.VMState == vmStateShelved || vm.VMState == vmStateShelvedOffloaded {
+				return finish("success")
+			}
+		default:
+			if vm.HostID != hostID {
+				return finish("success")
+			}
+		}
+
+		sleep(ctx, time.Duration(attempt*10)*time.Second)
+	}
+
+	return finish("timeout")
+}
+
+// sleep waits for d or ctx cancellation, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,119 @@
+package nova
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	th "github.com/gophercloud/gophercloud/testhelper"
+	thclient "github.com/gophercloud/gophercloud/testhelper/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/metrics"
+	"github.com/DTadrzak/nova-kubernetes-drain/nova/ratelimit"
+)
+
+func newTestHypervisor(steps []Step) *Hypervisor {
+	return &Hypervisor{
+		client:      thclient.ServiceClient(),
+		hostname:    "compute-1",
+		timeOut:     time.Second,
+		PolicySteps: steps,
+		pollLimiter: ratelimit.New(1000, 1000),
+	}
+}
+
+func TestRunPolicyStopStepSucceeds(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/servers/vm-1/action", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "POST")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	th.Mux.HandleFunc("/servers/vm-1", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"server": {"id": "vm-1", "status": "SHUTOFF", "OS-EXT-STS:vm_state": "stopped"}}`))
+	})
+
+	h := newTestHypervisor([]Step{StopStep})
+
+	if !h.runPolicy(context.Background(), "vm-1", "compute-1", "") {
+		t.Fatal("expected StopStep to evict the VM")
+	}
+}
+
+func TestRunPolicyFallsThroughToNextStepOnError(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	var actions int32
+	th.Mux.HandleFunc("/servers/vm-1/action", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "POST")
+		atomic.AddInt32(&actions, 1)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	h := newTestHypervisor([]Step{ShelveStep, StopStep})
+
+	if h.runPolicy(context.Background(), "vm-1", "compute-1", "") {
+		t.Fatal("expected runPolicy to fail once every step is exhausted")
+	}
+	if got := atomic.LoadInt32(&actions); got != 2 {
+		t.Fatalf("expected the stop step to be tried after the shelve step failed to start, got %d action requests", got)
+	}
+}
+
+func TestRunPolicyLabelsLiveMigrateMetricWithModeNotStepName(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/servers/vm-1/action", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "POST")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	th.Mux.HandleFunc("/servers/vm-1", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"server": {"id": "vm-1", "status": "ACTIVE", "HostID": "compute-2"}}`))
+	})
+
+	before := testutil.ToFloat64(metrics.VMMigrationsTotal.WithLabelValues("success", metrics.MigrationModeBlock))
+
+	h := newTestHypervisor([]Step{LiveMigrateStep})
+	if !h.runPolicy(context.Background(), "vm-1", "compute-1", "") {
+		t.Fatal("expected LiveMigrateStep to evict the VM")
+	}
+
+	after := testutil.ToFloat64(metrics.VMMigrationsTotal.WithLabelValues("success", metrics.MigrationModeBlock))
+	if after != before+1 {
+		t.Fatalf("expected vm_migrations_total{result=success,mode=block} to increment by 1, went from %v to %v", before, after)
+	}
+}
+
+func TestRunPolicyDetectsErrorVMState(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/servers/vm-1/action", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "POST")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	th.Mux.HandleFunc("/servers/vm-1", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"server": {"id": "vm-1", "status": "ACTIVE", "OS-EXT-STS:vm_state": "error"}}`))
+	})
+
+	h := newTestHypervisor([]Step{ShelveStep})
+
+	if h.runPolicy(context.Background(), "vm-1", "compute-1", "") {
+		t.Fatal("expected runPolicy to treat an ERROR vm_state as a failed step")
+	}
+}
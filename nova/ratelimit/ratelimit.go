@@ -0,0 +1,72 @@
+// Package ratelimit implements a small token-bucket limiter used to cap how
+// often nova-kubernetes-drain polls the Nova API while waiting for a VM to
+// change state, independent of the exponential backoff already applied
+// between retries of a single request.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket that refills at rate tokens per interval, up to
+// burst tokens. The zero value is not usable; use New.
+type Limiter struct {
+	mu       sync.Mutex
+	tokens   float64
+	burst    float64
+	rate     float64 // tokens per second
+	lastFill time.Time
+}
+
+// New creates a Limiter that allows up to burst requests immediately and
+// then admits ratePerSecond requests per second thereafter.
+func New(ratePerSecond float64, burst int) *Limiter {
+	return &Limiter{
+		tokens:   float64(burst),
+		burst:    float64(burst),
+		rate:     ratePerSecond,
+		lastFill: time.Now(),
+	}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		wait := l.reserve()
+		if wait <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// reserve refills the bucket, takes a token if one is available, and
+// returns how long the caller should wait before trying again otherwise.
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.lastFill).Seconds()
+	l.lastFill = now
+
+	l.tokens += elapsed * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	missing := 1 - l.tokens
+	return time.Duration(missing/l.rate*float64(time.Second)) + time.Millisecond
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewAllowsBurstImmediately(t *testing.T) {
+	l := New(1, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatalf("request %d within burst should not wait, got %v", i, err)
+		}
+	}
+}
+
+func TestWaitBlocksOnceBurstIsExhausted(t *testing.T) {
+	l := New(1000, 1)
+
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("first request should succeed immediately: %v", err)
+	}
+
+	start := time.Now()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("second request should still succeed after refill: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond {
+		t.Fatalf("expected the second request to wait for a refill, took %v", elapsed)
+	}
+}
+
+func TestWaitReturnsContextErrorWhenCancelledBeforeRefill(t *testing.T) {
+	l := New(1, 1) // 1 token/sec, burst of 1: exhausted after one call
+
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("first request should succeed immediately: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := l.Wait(ctx); err != ctx.Err() {
+		t.Fatalf("expected ctx.Err() once the wait outlives the deadline, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Package retry provides a small context-aware retry helper with
+// exponential backoff and jitter, plus a classifier that tells a caller
+// whether an OpenStack API error is worth retrying at all.
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// Policy configures how Do retries a func.
+type Policy struct {
+	// MaxAttempts is the total number of times fn is called, including the
+	// first attempt.
+	MaxAttempts int
+
+	// BaseDelay is the backoff before the second attempt; each subsequent
+	// attempt doubles it, capped at MaxDelay.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the backoff computed from BaseDelay.
+	MaxDelay time.Duration
+}
+
+// DefaultPolicy is a reasonable default for the short, frequent API calls
+// this package wraps (service list/enable/disable, server lookups).
+var DefaultPolicy = Policy{
+	MaxAttempts: 3,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// Do calls fn, retrying under policy while ctx is not done and the error fn
+// returns is classified as retriable. It returns the last error seen, or
+// ctx.Err() if ctx is cancelled while waiting between attempts.
+func Do(ctx context.Context, policy Policy, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !IsRetriable(err) {
+			return err
+		}
+		if attempt == policy.MaxAttempts-1 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(policy, attempt)):
+		}
+	}
+	return err
+}
+
+// backoff computes an exponential delay for attempt, in [delay/2, delay],
+// capped at policy.MaxDelay.
+func backoff(policy Policy, attempt int) time.Duration {
+	delay := policy.BaseDelay * time.Duration(int64(1)<<uint(attempt))
+	if delay > policy.MaxDelay || delay <= 0 {
+		delay = policy.MaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay/2 + jitter
+}
+
+// BlockMigrationSharedStorageError is the message Nova returns when a
+// live-migration requests block migration against a host pair that shares
+// storage. It can never succeed on retry, so migrateVMWithBM needs to see
+// it on the first attempt in order to fall back to migrateVMWithoutBM.
+const BlockMigrationSharedStorageError = "Block migration can not be used with shared storage."
+
+// IsRetriable classifies err as worth retrying: 5xx responses, 409
+// conflicts (Nova returns these while a live-migration is already in
+// flight), and connection resets. 401/403/404 are terminal - retrying an
+// auth or not-found failure never helps, and neither does retrying a
+// block-migration-on-shared-storage rejection.
+func IsRetriable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if strings.Contains(err.Error(), BlockMigrationSharedStorageError) {
+		return false
+	}
+
+	switch err.(type) {
+	case gophercloud.ErrDefault401, gophercloud.ErrDefault403, gophercloud.ErrDefault404:
+		return false
+	}
+
+	if uerr, ok := err.(gophercloud.ErrUnexpectedResponseCode); ok {
+		switch {
+		case uerr.Actual == 409:
+			return true
+		case uerr.Actual >= 500:
+			return true
+		case uerr.Actual == 401, uerr.Actual == 403, uerr.Actual == 404:
+			return false
+		}
+	}
+
+	if strings.Contains(err.Error(), "connection reset") {
+		return true
+	}
+
+	// Unknown errors default to retriable so unexpected transient failures
+	// (e.g. DNS hiccups) still get retried, matching the old open-coded
+	// loops' behavior.
+	return true
+}
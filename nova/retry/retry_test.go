@@ -0,0 +1,96 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+func TestIsRetriable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"401", gophercloud.ErrDefault401{}, false},
+		{"403", gophercloud.ErrDefault403{}, false},
+		{"404", gophercloud.ErrDefault404{}, false},
+		{"409 conflict", gophercloud.ErrUnexpectedResponseCode{Actual: 409}, true},
+		{"500", gophercloud.ErrUnexpectedResponseCode{Actual: 500}, true},
+		{"connection reset", errors.New("read tcp: connection reset by peer"), true},
+		{"block migration shared storage", errors.New("Block migration can not be used with shared storage."), false},
+		{"unknown error defaults retriable", errors.New("boom"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetriable(tt.err); got != tt.want {
+				t.Errorf("IsRetriable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoStopsOnFirstSuccess(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), DefaultPolicy, func() error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestDoStopsImmediatelyOnTerminalError(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), DefaultPolicy, func() error {
+		calls++
+		return gophercloud.ErrDefault404{}
+	})
+	if _, ok := err.(gophercloud.ErrDefault404); !ok {
+		t.Fatalf("expected the terminal error to be returned unchanged, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected exactly 1 call for a terminal error, got %d", calls)
+	}
+}
+
+func TestDoRetriesRetriableErrorUpToMaxAttempts(t *testing.T) {
+	calls := 0
+	policy := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	err := Do(context.Background(), policy, func() error {
+		calls++
+		return gophercloud.ErrUnexpectedResponseCode{Actual: 500}
+	})
+	if err == nil {
+		t.Fatal("expected the last error to be returned")
+	}
+	if calls != policy.MaxAttempts {
+		t.Fatalf("expected %d calls, got %d", policy.MaxAttempts, calls)
+	}
+}
+
+func TestDoAbortsOnContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := Do(ctx, DefaultPolicy, func() error {
+		calls++
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("expected no calls once ctx is already done, got %d", calls)
+	}
+}